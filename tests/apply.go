@@ -0,0 +1,126 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// e2eFieldManager identifies this test suite's changes to the API server so
+// conflicting server-side apply calls from other managers can be detected.
+const e2eFieldManager = "dynamic-nfs-provisioner-e2e"
+
+// ApplyConflictError is returned by Apply when the patch is rejected because
+// a field is owned by another field manager. Callers can inspect it to decide
+// whether to retry with force=true.
+type ApplyConflictError struct {
+	FieldManager string
+	Err          error
+}
+
+func (e *ApplyConflictError) Error() string {
+	return fmt.Sprintf("apply conflict: field manager %q does not own this field: %s", e.FieldManager, e.Err)
+}
+
+func (e *ApplyConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Apply performs a server-side apply of obj using fieldManager, creating the
+// object if it does not yet exist. It replaces the old Get + CreateTwoWayMergePatch
+// + Patch dance and works for any kind the dynamic client's RESTMapper knows
+// about (Deployments, StorageClasses, PVCs, Namespaces, CRs, ...). The patch
+// itself is bounded by k.timeoutOrDefault(), same as the readiness waits.
+func (k *KubeClient) Apply(ctx context.Context, obj runtime.Object, fieldManager string, force bool) error {
+	ctx, cancel := k.boundedContext(ctx)
+	defer cancel()
+
+	gvk, err := apiutilGVKForObject(obj)
+	if err != nil {
+		return errors.Wrap(err, "apply: unable to determine GroupVersionKind")
+	}
+
+	mapping, err := k.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return errors.Wrapf(err, "apply: no REST mapping for %s", gvk)
+	}
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return errors.Wrap(err, "apply: unable to access object metadata")
+	}
+
+	// Typed client-go objects (e.g. *appsv1.Deployment) carry an empty
+	// TypeMeta, so marshal a copy with the resolved GVK set rather than
+	// mutating the caller's object or sending a body the apiserver will
+	// reject for missing apiVersion/kind.
+	toMarshal := obj.DeepCopyObject()
+	toMarshal.GetObjectKind().SetGroupVersionKind(gvk)
+
+	data, err := json.Marshal(toMarshal)
+	if err != nil {
+		return errors.Wrap(err, "apply: unable to marshal object")
+	}
+
+	var resource dynamic.ResourceInterface
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		resource = k.dynamicClient.Resource(mapping.Resource).Namespace(accessor.GetNamespace())
+	} else {
+		resource = k.dynamicClient.Resource(mapping.Resource)
+	}
+
+	_, err = resource.Patch(ctx, accessor.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+	if err != nil {
+		if k8serrors.IsConflict(err) {
+			return &ApplyConflictError{FieldManager: fieldManager, Err: err}
+		}
+		return errors.Wrapf(err, "apply: failed to patch %s %s/%s", gvk.Kind, accessor.GetNamespace(), accessor.GetName())
+	}
+	return nil
+}
+
+// apiutilGVKForObject resolves the GroupVersionKind for obj, preferring any
+// TypeMeta already set on it and falling back to the client-go scheme.
+func apiutilGVKForObject(obj runtime.Object) (schema.GroupVersionKind, error) {
+	if gvk := obj.GetObjectKind().GroupVersionKind(); !gvk.Empty() {
+		return gvk, nil
+	}
+
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	if len(gvks) == 0 {
+		return schema.GroupVersionKind{}, errors.Errorf("no registered kind for %T", obj)
+	}
+	return gvks[0], nil
+}
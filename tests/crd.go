@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// customResourceDefinitionGK is the GroupKind of CustomResourceDefinition
+// itself, used to pick CRD documents out of a mixed manifest.
+var customResourceDefinitionGK = apiextensionsv1.SchemeGroupVersion.WithKind("CustomResourceDefinition").GroupKind()
+
+// CreateCRD creates the given CustomResourceDefinition and waits for it to
+// become Established, so callers can immediately start creating CRs of that
+// kind without racing the API server.
+func (k *KubeClient) CreateCRD(ctx context.Context, crd *apiextensionsv1.CustomResourceDefinition) error {
+	_, err := k.apiextensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, crd, metav1.CreateOptions{})
+	if err != nil {
+		if !k8serrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create CRD %s", crd.Name)
+		}
+	}
+	if err := k.WaitForCRDEstablished(ctx, crd.Name); err != nil {
+		return err
+	}
+
+	// The RESTMapper was built from a discovery snapshot taken before this
+	// CRD existed, so its kind won't resolve yet. Reset it now that the CRD
+	// is Established, so the very next Apply of a CR of this kind succeeds
+	// instead of failing with "no REST mapping".
+	if resettable, ok := k.restMapper.(meta.ResettableRESTMapper); ok {
+		resettable.Reset()
+	}
+	return nil
+}
+
+// WaitForCRDEstablished polls the named CRD's Established condition, bounded
+// by the client's timeout.
+func (k *KubeClient) WaitForCRDEstablished(ctx context.Context, name string) error {
+	ctx, cancel := k.boundedContext(ctx)
+	defer cancel()
+
+	return wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		crd, err := k.apiextensionsClient.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		for _, cond := range crd.Status.Conditions {
+			if cond.Type == apiextensionsv1.NamesAccepted && cond.Status == apiextensionsv1.ConditionFalse {
+				return false, errors.Errorf("CRD %s names not accepted: %s", name, cond.Reason)
+			}
+			if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, ctx.Done())
+}
+
+// CreateUnstructuredFromYAML decodes the multi-document YAML in data into
+// unstructured.Unstructured objects and applies each one other than a
+// CustomResourceDefinition through the dynamic client, using the RESTMapping
+// discovered for its GroupVersionKind. This
+// lets tests install CRs (and CRDs, Deployments, etc.) straight from a chart
+// or manifest file without hand-wiring a typed client per kind.
+//
+// Any CustomResourceDefinition documents are created (and waited on to
+// become Established) before the remaining documents are applied, so a
+// manifest that defines a CRD and then a CR of it in the same file doesn't
+// race the CR against the CRD's own establishment.
+func (k *KubeClient) CreateUnstructuredFromYAML(ctx context.Context, ns string, data []byte) error {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+
+	var crds []*apiextensionsv1.CustomResourceDefinition
+	var rest []*unstructured.Unstructured
+
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "CreateUnstructuredFromYAML: failed to read YAML document")
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(doc, &obj.Object); err != nil {
+			return errors.Wrap(err, "CreateUnstructuredFromYAML: failed to decode document")
+		}
+		if obj.GetNamespace() == "" && ns != "" {
+			obj.SetNamespace(ns)
+		}
+
+		if obj.GroupVersionKind().GroupKind() == customResourceDefinitionGK {
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, crd); err != nil {
+				return errors.Wrapf(err, "CreateUnstructuredFromYAML: failed to decode CRD %s", obj.GetName())
+			}
+			crds = append(crds, crd)
+			continue
+		}
+		rest = append(rest, obj)
+	}
+
+	for _, crd := range crds {
+		if err := k.CreateCRD(ctx, crd); err != nil {
+			return errors.Wrapf(err, "CreateUnstructuredFromYAML: failed to create CRD %s", crd.Name)
+		}
+	}
+
+	for _, obj := range rest {
+		if err := k.Apply(ctx, obj, e2eFieldManager, true); err != nil {
+			return errors.Wrapf(err, "CreateUnstructuredFromYAML: failed to apply %s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+		}
+	}
+	return nil
+}
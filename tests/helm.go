@@ -0,0 +1,259 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helmrelease "helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// InstallOptions controls KubeClient.InstallChart.
+type InstallOptions struct {
+	// Wait blocks InstallChart until every resource the chart creates is
+	// ready (via Helm's own kube.Waiter), not just submitted to the API server.
+	Wait bool
+	// Timeout bounds the install; zero defaults to the client's timeout.
+	Timeout time.Duration
+	// Atomic rolls the release back if the install fails partway through.
+	Atomic bool
+}
+
+// Release is the handle InstallChart returns; pass its Name to UninstallChart.
+type Release struct {
+	Name      string
+	Namespace string
+
+	helmRelease *helmrelease.Release
+}
+
+// releaseStore tracks installed releases by name so UninstallChart can find
+// the namespace they live in without the caller re-supplying it.
+type releaseStore struct {
+	mu     sync.Mutex
+	byName map[string]*Release
+}
+
+func newReleaseStore() *releaseStore {
+	return &releaseStore{byName: map[string]*Release{}}
+}
+
+func (s *releaseStore) put(r *Release) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byName[r.Name] = r
+}
+
+func (s *releaseStore) get(name string) (*Release, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byName[name]
+	return r, ok
+}
+
+func (s *releaseStore) delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byName, name)
+}
+
+// restClientGetter adapts the *rest.Config and meta.RESTMapper KubeClient
+// already holds to the genericclioptions.RESTClientGetter interface Helm's
+// action.Configuration needs.
+type restClientGetter struct {
+	config     *rest.Config
+	restMapper meta.RESTMapper
+}
+
+func (g *restClientGetter) ToRESTConfig() (*rest.Config, error) {
+	return g.config, nil
+}
+
+func (g *restClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(g.config)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *restClientGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	return g.restMapper, nil
+}
+
+func (g *restClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return clientcmd.NewDefaultClientConfig(clientcmdapi.Config{}, &clientcmd.ConfigOverrides{})
+}
+
+// helmActionConfig builds a Helm action.Configuration backed by the same
+// *rest.Config already held by KubeClient, scoped to namespace.
+func (k *KubeClient) helmActionConfig(namespace string) (*action.Configuration, error) {
+	cfg := new(action.Configuration)
+	getter := &restClientGetter{config: k.config, restMapper: k.restMapper}
+	if err := cfg.Init(getter, namespace, "secret", func(string, ...interface{}) {}); err != nil {
+		return nil, errors.Wrap(err, "failed to initialize helm action configuration")
+	}
+	return cfg, nil
+}
+
+// InstallChart installs the chart at chartPath as releaseName in namespace,
+// exercising the real chart the module ships instead of a code-duplicated
+// Deployment/StorageClass spec, so template/values regressions show up here.
+func (k *KubeClient) InstallChart(ctx context.Context, chartPath, releaseName, namespace string, values map[string]interface{}, opts InstallOptions) (*Release, error) {
+	cfg, err := k.helmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	chrt, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "InstallChart: failed to load chart at %s", chartPath)
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = k.timeoutOrDefault()
+	}
+
+	install := action.NewInstall(cfg)
+	install.ReleaseName = releaseName
+	install.Namespace = namespace
+	install.CreateNamespace = true
+	install.Wait = opts.Wait
+	install.Atomic = opts.Atomic
+	install.Timeout = timeout
+
+	// If ctx is done before Run finishes, the install keeps running in the
+	// background (Helm 3.5's Install.Run has no cancellation hook); record
+	// it here so a later UninstallChart can still find and clean it up
+	// instead of it becoming an untracked, orphaned release.
+	onDone := func(rel *helmrelease.Release, err error) {
+		if err == nil && rel != nil {
+			k.releases.put(&Release{Name: rel.Name, Namespace: rel.Namespace, helmRelease: rel})
+		}
+	}
+
+	helmRel, err := runInstall(ctx, install, chrt, values, onDone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "InstallChart: failed to install release %s/%s", namespace, releaseName)
+	}
+
+	rel := &Release{Name: helmRel.Name, Namespace: helmRel.Namespace, helmRelease: helmRel}
+	k.releases.put(rel)
+	return rel, nil
+}
+
+// UninstallChart uninstalls the release previously returned by InstallChart.
+func (k *KubeClient) UninstallChart(ctx context.Context, releaseName string) error {
+	rel, ok := k.releases.get(releaseName)
+	namespace := ""
+	if ok {
+		namespace = rel.Namespace
+	}
+
+	cfg, err := k.helmActionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	uninstall := action.NewUninstall(cfg)
+	uninstall.Timeout = k.timeoutOrDefault()
+
+	// Same caveat as runInstall: Helm 3.5's Uninstall.Run has no context
+	// support, so ctx only bounds how long we wait here, not the uninstall
+	// itself. onDone drops the release from the store once Run actually
+	// returns, even if that's after ctx is already done.
+	onDone := func(_ *helmrelease.UninstallReleaseResponse, err error) {
+		if err == nil {
+			k.releases.delete(releaseName)
+		}
+	}
+
+	if _, err := runUninstall(ctx, uninstall, releaseName, onDone); err != nil {
+		return errors.Wrapf(err, "UninstallChart: failed to uninstall release %s", releaseName)
+	}
+	return nil
+}
+
+// runInstall calls action.Install.Run on a background goroutine and returns
+// as soon as it completes or ctx is done, whichever happens first.
+//
+// Helm 3.5's Install.Run takes no context, so it cannot actually be aborted
+// mid-flight: if ctx is done first, Run keeps executing against the cluster
+// after this function returns. onDone is always called once Run returns,
+// cancelled or not, so the caller can still account for (and clean up) a
+// release that finishes installing after its caller gave up on it.
+func runInstall(ctx context.Context, install *action.Install, chrt *chart.Chart, values map[string]interface{}, onDone func(*helmrelease.Release, error)) (*helmrelease.Release, error) {
+	type result struct {
+		rel *helmrelease.Release
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rel, err := install.Run(chrt, values)
+		done <- result{rel: rel, err: err}
+		onDone(rel, err)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "install of %s continues in the background and was not cancelled", install.ReleaseName)
+	case res := <-done:
+		return res.rel, res.err
+	}
+}
+
+// runUninstall calls action.Uninstall.Run on a background goroutine and
+// returns as soon as it completes or ctx is done, whichever happens first.
+//
+// Like runInstall, this can't actually cancel the uninstall: Helm 3.5's
+// Uninstall.Run takes no context either, so if ctx is done first, Run keeps
+// executing against the cluster after this function returns. onDone is
+// always called once Run returns, cancelled or not, so the caller can still
+// account for a release that finishes uninstalling after its caller gave up
+// on it.
+func runUninstall(ctx context.Context, uninstall *action.Uninstall, releaseName string, onDone func(*helmrelease.UninstallReleaseResponse, error)) (*helmrelease.UninstallReleaseResponse, error) {
+	type result struct {
+		res *helmrelease.UninstallReleaseResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := uninstall.Run(releaseName)
+		done <- result{res: res, err: err}
+		onDone(res, err)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "uninstall of %s continues in the background and was not cancelled", releaseName)
+	case res := <-done:
+		return res.res, res.err
+	}
+}
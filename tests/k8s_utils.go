@@ -18,7 +18,7 @@ package tests
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -27,22 +27,50 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiextensionsscheme "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/scheme"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
-	types "k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// DefaultTimeout bounds KubeClient's Apply, readiness waits and Helm
+// install/uninstall timeouts when the caller has not set one via WithTimeout,
+// mirroring Helm's move from Int64Var seconds to DurationVar timeouts.
+const DefaultTimeout = 5 * time.Minute
+
 // KubeClient interface for k8s API
 type KubeClient struct {
 	kubernetes.Interface
 	config *rest.Config
+
+	// dynamicClient and restMapper back Apply, letting it patch arbitrary
+	// kinds (Deployments, StorageClasses, PVCs, Namespaces, CRs, ...)
+	// instead of one typed client per kind.
+	dynamicClient dynamic.Interface
+	restMapper    meta.RESTMapper
+
+	// apiextensionsClient manages CustomResourceDefinitions themselves,
+	// separate from the CRs they define (which go through dynamicClient).
+	apiextensionsClient apiextensionsclientset.Interface
+
+	// timeout overrides DefaultTimeout for Apply, the readiness waits and the
+	// Helm install/uninstall timeouts; set via WithTimeout. The plain
+	// get/list/create/delete helpers are bounded only by the caller's ctx.
+	timeout time.Duration
+
+	// releases tracks charts installed through InstallChart so UninstallChart
+	// can find them again by name.
+	releases *releaseStore
 }
 
 // Client for KubeClient
@@ -51,6 +79,28 @@ var Client *KubeClient
 // encoder to print object in yaml format
 var encoder runtime.Encoder
 
+// WithTimeout returns a shallow copy of k whose Apply calls and readiness
+// waits are each bounded by d instead of DefaultTimeout, e.g.
+// Client.WithTimeout(5*time.Minute).createPVC(ctx, pvc).
+func (k *KubeClient) WithTimeout(d time.Duration) *KubeClient {
+	c := *k
+	c.timeout = d
+	return &c
+}
+
+// timeoutOrDefault returns k.timeout if set, else DefaultTimeout.
+func (k *KubeClient) timeoutOrDefault() time.Duration {
+	if k.timeout > 0 {
+		return k.timeout
+	}
+	return DefaultTimeout
+}
+
+// boundedContext derives a child of ctx that also respects k.timeoutOrDefault.
+func (k *KubeClient) boundedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, k.timeoutOrDefault())
+}
+
 // getHomeDir gets the home directory for the system.
 // It is required to locate the .kube/config file
 func getHomeDir() (string, error) {
@@ -87,55 +137,57 @@ func initK8sClient(kubeConfigPath string) error {
 		return nil
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	apiextensionsClient, err := apiextensionsclientset.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	// A deferred, memory-cached mapper (rather than a one-time snapshot) so
+	// CreateCRD can call Reset() once a CRD is Established and have CRs of
+	// it resolve on the very next Apply.
+	restMapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
 	scheme := runtime.NewScheme()
+	if err := apiextensionsscheme.AddToScheme(scheme); err != nil {
+		return err
+	}
 	serializerInfo, found := runtime.SerializerInfoForMediaType(serializer.NewCodecFactory(scheme).SupportedMediaTypes(), "application/yaml")
 	if found {
 		encoder = serializerInfo.Serializer
 	}
 
 	Client = &KubeClient{
-		Interface: client,
-		config:    config,
+		Interface:           client,
+		config:              config,
+		dynamicClient:       dynamicClient,
+		restMapper:          restMapper,
+		apiextensionsClient: apiextensionsClient,
+		releases:            newReleaseStore(),
 	}
 	return nil
 }
 
-func (k *KubeClient) waitForPods(podNamespace, labelSelector string, expectedPhase corev1.PodPhase, expectedCount int) error {
-	dumpLog := 0
-	for {
-		podList, err := k.CoreV1().Pods(podNamespace).List(metav1.ListOptions{LabelSelector: labelSelector})
-		if err != nil {
-			return err
-		}
-
-		count := 0
-		for _, pod := range podList.Items {
-			if pod.Status.Phase == expectedPhase {
-				count++
-			}
-		}
-
-		if count == expectedCount {
-			break
-		}
-
-		time.Sleep(5 * time.Second)
-
-		if dumpLog > 6 {
-			fmt.Printf("checking for pod with labelSelector=%s in ns=%s, count=%d expectedCount=%d\n", labelSelector, podNamespace, count, expectedCount)
-			dumpLog = 0
-		}
-		dumpLog++
-	}
-	return nil
+// waitForPods is a thin wrapper over Waiter.WaitForPodCount, bounded by the
+// client's timeout so a hung rollout fails the test instead of the suite.
+func (k *KubeClient) waitForPods(ctx context.Context, podNamespace, labelSelector string, expectedPhase corev1.PodPhase, expectedCount int) error {
+	return newWaiter(k).WaitForPodCount(ctx, podNamespace, labelSelector, expectedPhase, expectedCount, WaitOptions{Timeout: k.timeoutOrDefault()})
 }
 
-func (k *KubeClient) listPods(podNamespace string, labelSelector string) (*corev1.PodList, error) {
-	return k.CoreV1().Pods(podNamespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+func (k *KubeClient) listPods(ctx context.Context, podNamespace string, labelSelector string) (*corev1.PodList, error) {
+	return k.CoreV1().Pods(podNamespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
 }
 
-func (k *KubeClient) createNamespace(namespace string) error {
-	_, err := k.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+func (k *KubeClient) createNamespace(ctx context.Context, namespace string) error {
+	_, err := k.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			o := &corev1.Namespace{
@@ -143,83 +195,60 @@ func (k *KubeClient) createNamespace(namespace string) error {
 					Name: namespace,
 				},
 			}
-			_, err = k.CoreV1().Namespaces().Create(o)
+			_, err = k.CoreV1().Namespaces().Create(ctx, o, metav1.CreateOptions{})
 		}
 	}
 	return err
 }
 
-// WaitForNamespaceCleanup wait for cleanup of the given namespace
-func (k *KubeClient) WaitForNamespaceCleanup(ns string) error {
-	dumpLog := 0
-	for {
-		nsObj, err := k.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
-		if k8serrors.IsNotFound(err) {
-			return nil
-		}
-
-		if err != nil {
-			return err
-		}
-
-		if dumpLog > 6 {
-			fmt.Printf("Waiting for cleanup of namespace %s\n", ns)
-			dumpK8sObject(nsObj)
-			dumpLog = 0
-		}
-
-		dumpLog++
-		time.Sleep(5 * time.Second)
-	}
+// WaitForNamespaceCleanup is a thin wrapper over Waiter.WaitForNamespaceDeleted,
+// bounded by the client's timeout instead of polling forever.
+func (k *KubeClient) WaitForNamespaceCleanup(ctx context.Context, ns string) error {
+	return newWaiter(k).WaitForNamespaceDeleted(ctx, ns, WaitOptions{Timeout: k.timeoutOrDefault()})
 }
 
-func (k *KubeClient) destroyNamespace(namespace string) error {
-	err := k.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{})
+func (k *KubeClient) destroyNamespace(ctx context.Context, namespace string) error {
+	err := k.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			return nil
 		}
-		return k.WaitForNamespaceCleanup(namespace)
+		return k.WaitForNamespaceCleanup(ctx, namespace)
 	}
 	return nil
 }
 
-func (k *KubeClient) waitForPVCBound(pvc, ns string) (corev1.PersistentVolumeClaimPhase, error) {
-	for {
-		o, err := k.CoreV1().
-			PersistentVolumeClaims(ns).
-			Get(pvc, metav1.GetOptions{})
-		if err != nil {
-			return "", err
-		}
+// waitForPVCBound is a thin wrapper over Waiter.WaitForResources for a single
+// PersistentVolumeClaim.
+func (k *KubeClient) waitForPVCBound(ctx context.Context, pvc, ns string) (corev1.PersistentVolumeClaimPhase, error) {
+	obj := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: pvc, Namespace: ns},
+	}
+	if err := newWaiter(k).WaitForResources(ctx, []runtime.Object{obj}, WaitOptions{Timeout: k.timeoutOrDefault()}); err != nil {
+		return "", err
+	}
 
-		if o.Status.Phase == corev1.ClaimLost {
-			return o.Status.Phase, errors.Errorf("PVC %s/%s in lost state", ns, pvc)
-		}
-		if o.Status.Phase == corev1.ClaimBound {
-			return o.Status.Phase, nil
-		}
-		time.Sleep(5 * time.Second)
+	o, err := k.CoreV1().PersistentVolumeClaims(ns).Get(ctx, pvc, metav1.GetOptions{})
+	if err != nil {
+		return "", err
 	}
+	return o.Status.Phase, nil
 }
 
-func (k *KubeClient) createPVC(pvc *corev1.PersistentVolumeClaim) error {
-	_, err := k.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(pvc)
-	if err != nil {
-		if !k8serrors.IsAlreadyExists(err) {
-			return err
-		}
+func (k *KubeClient) createPVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if err := k.Apply(ctx, pvc, e2eFieldManager, false); err != nil {
+		return err
 	}
-	_, err = k.waitForPVCBound(pvc.Name, pvc.Namespace)
+	_, err := k.waitForPVCBound(ctx, pvc.Name, pvc.Namespace)
 	return err
 }
 
-func (k *KubeClient) getPVC(pvcNamespace, pvcName string) (*corev1.PersistentVolumeClaim, error) {
-	return k.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(pvcName, metav1.GetOptions{})
+func (k *KubeClient) getPVC(ctx context.Context, pvcNamespace, pvcName string) (*corev1.PersistentVolumeClaim, error) {
+	return k.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(ctx, pvcName, metav1.GetOptions{})
 }
 
-func (k *KubeClient) deletePVC(namespace, pvc string) error {
-	err := k.CoreV1().PersistentVolumeClaims(namespace).Delete(pvc, &metav1.DeleteOptions{})
+func (k *KubeClient) deletePVC(ctx context.Context, namespace, pvc string) error {
+	err := k.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, pvc, metav1.DeleteOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			err = nil
@@ -229,65 +258,36 @@ func (k *KubeClient) deletePVC(namespace, pvc string) error {
 	return err
 }
 
-func (k *KubeClient) createDeployment(deployment *appsv1.Deployment) error {
-	_, err := k.AppsV1().Deployments(deployment.Namespace).Create(deployment)
-	if err != nil {
-		if k8serrors.IsAlreadyExists(err) {
-			return nil
-		}
+func (k *KubeClient) createDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	if err := k.Apply(ctx, deployment, e2eFieldManager, false); err != nil {
 		return errors.Errorf("Failed to create deployment %s/%s, err=%s", deployment.Namespace, deployment.Name, err)
 	}
 	return nil
 }
 
-func (k *KubeClient) applyDeployment(deployment *appsv1.Deployment) error {
-	// TODO: Use server side apply
-	currentDeployment, err := k.AppsV1().
-		Deployments(deployment.Namespace).
-		Get(deployment.Name, metav1.GetOptions{})
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			_, err := k.AppsV1().Deployments(deployment.Namespace).Create(deployment)
-			if err != nil {
-				return errors.Errorf("Failed to create deployment %s/%s, err=%s", deployment.Namespace, deployment.Name, err)
-			}
-		}
-		return err
-	}
-
-	data, _, err := getPatchData(currentDeployment, deployment)
-	if err != nil {
-		return err
-	}
-
-	// Patch the depployment
-	_, err = k.AppsV1().
-		Deployments(deployment.Namespace).
-		Patch(deployment.Name,
-			types.StrategicMergePatchType,
-			data,
-		)
-	if err != nil {
+// applyDeployment server-side applies deployment and waits for the rollout
+// to finish.
+func (k *KubeClient) applyDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	if err := k.Apply(ctx, deployment, e2eFieldManager, true); err != nil {
 		return err
 	}
-
-	return k.waitForDeploymentRollout(deployment.Namespace, deployment.Name)
+	return k.waitForDeploymentRollout(ctx, deployment.Namespace, deployment.Name)
 }
 
-func (k *KubeClient) deleteDeployment(namespace, deployment string) error {
-	return k.AppsV1().Deployments(namespace).Delete(deployment, &metav1.DeleteOptions{})
+func (k *KubeClient) deleteDeployment(ctx context.Context, namespace, deployment string) error {
+	return k.AppsV1().Deployments(namespace).Delete(ctx, deployment, metav1.DeleteOptions{})
 }
 
-func (k *KubeClient) getDeployment(namespace, deployment string) (*appsv1.Deployment, error) {
-	return k.AppsV1().Deployments(namespace).Get(deployment, metav1.GetOptions{})
+func (k *KubeClient) getDeployment(ctx context.Context, namespace, deployment string) (*appsv1.Deployment, error) {
+	return k.AppsV1().Deployments(namespace).Get(ctx, deployment, metav1.GetOptions{})
 }
 
-func (k *KubeClient) updateDeployment(deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
-	return k.AppsV1().Deployments(deployment.Namespace).Update(deployment)
+func (k *KubeClient) updateDeployment(ctx context.Context, deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	return k.AppsV1().Deployments(deployment.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
 }
 
-func (k *KubeClient) listDeployments(namespace, labelSelector string) (*appsv1.DeploymentList, error) {
-	return k.AppsV1().Deployments(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+func (k *KubeClient) listDeployments(ctx context.Context, namespace, labelSelector string) (*appsv1.DeploymentList, error) {
+	return k.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
 }
 
 func dumpK8sObject(obj runtime.Object) {
@@ -301,87 +301,24 @@ func dumpK8sObject(obj runtime.Object) {
 	fmt.Println(string(buf.Bytes()))
 }
 
-func (k *KubeClient) createStorageClass(sc *storagev1.StorageClass) error {
-	_, err := k.StorageV1().StorageClasses().Create(sc)
-	if err != nil {
-		if !k8serrors.IsAlreadyExists(err) {
-			return err
-		}
-	}
-	return nil
+func (k *KubeClient) createStorageClass(ctx context.Context, sc *storagev1.StorageClass) error {
+	return k.Apply(ctx, sc, e2eFieldManager, false)
 }
 
-func (k *KubeClient) deleteStorageClass(scName string) error {
-	return k.StorageV1().StorageClasses().Delete(scName, &metav1.DeleteOptions{})
+func (k *KubeClient) deleteStorageClass(ctx context.Context, scName string) error {
+	return k.StorageV1().StorageClasses().Delete(ctx, scName, metav1.DeleteOptions{})
 }
 
 // Add Node related operations
-func (k *KubeClient) listNodes(labelSelector string) (*corev1.NodeList, error) {
-	return k.CoreV1().Nodes().List(metav1.ListOptions{LabelSelector: labelSelector})
+func (k *KubeClient) listNodes(ctx context.Context, labelSelector string) (*corev1.NodeList, error) {
+	return k.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
 }
 
-func getPatchData(oldObj, newObj interface{}) ([]byte, []byte, error) {
-	oldData, err := json.Marshal(oldObj)
-	if err != nil {
-		return nil, nil, fmt.Errorf("marshal old object failed: %v", err)
-	}
-	newData, err := json.Marshal(newObj)
-	if err != nil {
-		return nil, nil, fmt.Errorf("mashal new object failed: %v", err)
-	}
-	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, oldObj)
-	if err != nil {
-		return nil, nil, fmt.Errorf("CreateTwoWayMergePatch failed: %v", err)
+// waitForDeploymentRollout is a thin wrapper over Waiter.WaitForResources
+// bounded by the client's timeout instead of wait.PollInfinite.
+func (k *KubeClient) waitForDeploymentRollout(ctx context.Context, ns, deployment string) error {
+	obj := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: deployment, Namespace: ns},
 	}
-	return patchBytes, oldData, nil
-}
-
-func (k *KubeClient) waitForDeploymentRollout(ns, deployment string) error {
-	return wait.PollInfinite(2*time.Second, func() (bool, error) {
-		deploy, err := k.AppsV1().Deployments(ns).Get(deployment, metav1.GetOptions{})
-		if err != nil {
-			return true, err
-		}
-
-		var cond *appsv1.DeploymentCondition
-		// list all conditions and and select that condition which type is Progressing.
-		for i := range deploy.Status.Conditions {
-			c := deploy.Status.Conditions[i]
-			if c.Type == appsv1.DeploymentProgressing {
-				cond = &c
-			}
-		}
-		// if deploy.Generation <= deploy.Status.ObservedGeneration then deployment spec is not updated yet.
-		// it marked IsRolledout as false and update message accordingly
-		if deploy.Generation <= deploy.Status.ObservedGeneration {
-			// If Progressing condition's reason is ProgressDeadlineExceeded then it is not rolled out.
-			if cond != nil && cond.Reason == "ProgressDeadlineExceeded" {
-				return false, errors.New(fmt.Sprintf("deployment exceeded its progress deadline"))
-			}
-			// if deploy.Status.UpdatedReplicas < *deploy.Spec.Replicas then some of the replicas are updated
-			// and some of them are not. It marked IsRolledout as false and update message accordingly
-			if deploy.Spec.Replicas != nil && deploy.Status.UpdatedReplicas < *deploy.Spec.Replicas {
-				fmt.Printf("Waiting for deployment rollout to finish: %d out of %d new replicas have been updated\n",
-					deploy.Status.UpdatedReplicas, *deploy.Spec.Replicas)
-				return false, nil
-			}
-			// if deploy.Status.Replicas > deploy.Status.UpdatedReplicas then some of the older replicas are in running state
-			// because newer replicas are not in running state. It waits for newer replica to come into reunning state then terminate.
-			// It marked IsRolledout as false and update message accordingly
-			if deploy.Status.Replicas > deploy.Status.UpdatedReplicas {
-				fmt.Printf("Waiting for deployment rollout to finish: %d old replicas are pending termination\n",
-					deploy.Status.Replicas-deploy.Status.UpdatedReplicas)
-				return false, nil
-			}
-			// if deploy.Status.AvailableReplicas < deploy.Status.UpdatedReplicas then all the replicas are updated but they are
-			// not in running state. It marked IsRolledout as false and update message accordingly.
-			if deploy.Status.AvailableReplicas < deploy.Status.UpdatedReplicas {
-				fmt.Printf("Waiting for deployment rollout to finish: %d of %d updated replicas are available\n",
-					deploy.Status.AvailableReplicas, deploy.Status.UpdatedReplicas)
-			}
-			return true, nil
-		}
-		fmt.Printf("Waiting for deployment spec update to be observed\n")
-		return false, nil
-	})
+	return newWaiter(k).WaitForResources(ctx, []runtime.Object{obj}, WaitOptions{Timeout: k.timeoutOrDefault()})
 }
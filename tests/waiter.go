@@ -0,0 +1,335 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// defaultWaitInterval is how often the waiter re-checks readiness.
+const defaultWaitInterval = 2 * time.Second
+
+// WaitOptions controls how WaitForResources polls for readiness.
+type WaitOptions struct {
+	// Timeout bounds the overall wait; zero defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Interval is the polling interval; zero defaults to 2s.
+	Interval time.Duration
+}
+
+// Waiter polls the API server until a set of objects reach a kind-specific
+// ready state. It is modeled on Helm 3.5's kube.Waiter/ReadyChecker so that
+// callers get the same "one object, one readiness definition per kind"
+// behaviour instead of a bespoke poll loop per resource.
+type Waiter struct {
+	client *KubeClient
+}
+
+func newWaiter(client *KubeClient) *Waiter {
+	return &Waiter{client: client}
+}
+
+// WaitForResources blocks until every object in objs reports ready, or until
+// ctx is done / opts.Timeout elapses, whichever comes first.
+func (w *Waiter) WaitForResources(ctx context.Context, objs []runtime.Object, opts WaitOptions) error {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	interval := opts.Interval
+	if interval == 0 {
+		interval = defaultWaitInterval
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, obj := range objs {
+		obj := obj
+		if err := wait.PollImmediateUntil(interval, func() (bool, error) {
+			return w.isReady(ctx, obj)
+		}, ctx.Done()); err != nil {
+			return errors.Wrapf(err, "resource not ready: %s", describeObject(obj))
+		}
+	}
+	return nil
+}
+
+// WaitForPodCount blocks until exactly expectedCount pods matching
+// labelSelector in namespace report phase expectedPhase, or until ctx is
+// done / opts.Timeout elapses, whichever comes first. A pod count is a
+// readiness condition over a set of objects rather than a single one, so
+// unlike WaitForResources it doesn't fit the one-object-per-kind model and
+// polls directly instead.
+func (w *Waiter) WaitForPodCount(ctx context.Context, namespace, labelSelector string, expectedPhase corev1.PodPhase, expectedCount int, opts WaitOptions) error {
+	ctx, cancel := w.boundedPollContext(ctx, opts)
+	defer cancel()
+
+	dumpLog := 0
+	return wait.PollImmediateUntil(w.interval(opts), func() (bool, error) {
+		podList, err := w.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return false, err
+		}
+
+		count := 0
+		for _, pod := range podList.Items {
+			if pod.Status.Phase == expectedPhase {
+				count++
+			}
+		}
+		if count == expectedCount {
+			return true, nil
+		}
+
+		if dumpLog > 6 {
+			fmt.Printf("checking for pod with labelSelector=%s in ns=%s, count=%d expectedCount=%d\n", labelSelector, namespace, count, expectedCount)
+			dumpLog = 0
+		}
+		dumpLog++
+		return false, nil
+	}, ctx.Done())
+}
+
+// WaitForNamespaceDeleted blocks until namespace ns no longer exists, or
+// until ctx is done / opts.Timeout elapses, whichever comes first. Like
+// WaitForPodCount, this is the absence of an object rather than a single
+// object's readiness, so it polls directly instead of going through
+// WaitForResources.
+func (w *Waiter) WaitForNamespaceDeleted(ctx context.Context, ns string, opts WaitOptions) error {
+	ctx, cancel := w.boundedPollContext(ctx, opts)
+	defer cancel()
+
+	dumpLog := 0
+	return wait.PollImmediateUntil(w.interval(opts), func() (bool, error) {
+		nsObj, err := w.client.CoreV1().Namespaces().Get(ctx, ns, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if dumpLog > 6 {
+			fmt.Printf("Waiting for cleanup of namespace %s\n", ns)
+			dumpK8sObject(nsObj)
+			dumpLog = 0
+		}
+		dumpLog++
+		return false, nil
+	}, ctx.Done())
+}
+
+// boundedPollContext applies opts.Timeout (defaulting to DefaultTimeout) the
+// same way WaitForResources does, for waiter methods that poll directly.
+func (w *Waiter) boundedPollContext(ctx context.Context, opts WaitOptions) (context.Context, context.CancelFunc) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (w *Waiter) interval(opts WaitOptions) time.Duration {
+	if opts.Interval != 0 {
+		return opts.Interval
+	}
+	return defaultWaitInterval
+}
+
+func (w *Waiter) isReady(ctx context.Context, obj runtime.Object) (bool, error) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return w.isPodReady(ctx, o)
+	case *corev1.PersistentVolumeClaim:
+		return w.isPVCBound(ctx, o)
+	case *corev1.Service:
+		return w.isServiceReady(ctx, o)
+	case *appsv1.Deployment:
+		return w.isDeploymentReady(ctx, o)
+	case *appsv1.StatefulSet:
+		return w.isStatefulSetReady(ctx, o)
+	case *appsv1.DaemonSet:
+		return w.isDaemonSetReady(ctx, o)
+	case *batchv1.Job:
+		return w.isJobReady(ctx, o)
+	default:
+		return false, errors.Errorf("wait: unsupported object kind %T", obj)
+	}
+}
+
+func (w *Waiter) isPodReady(ctx context.Context, o *corev1.Pod) (bool, error) {
+	pod, err := w.client.CoreV1().Pods(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if pod.Status.Phase == corev1.PodFailed {
+		return false, errors.Errorf("pod %s/%s failed", pod.Namespace, pod.Name)
+	}
+
+	ready := false
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			ready = c.Status == corev1.ConditionTrue
+		}
+	}
+	if !ready {
+		return false, nil
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !cs.Ready {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (w *Waiter) isPVCBound(ctx context.Context, o *corev1.PersistentVolumeClaim) (bool, error) {
+	pvc, err := w.client.CoreV1().PersistentVolumeClaims(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if pvc.Status.Phase == corev1.ClaimLost {
+		return false, errors.Errorf("PVC %s/%s in lost state", pvc.Namespace, pvc.Name)
+	}
+	return pvc.Status.Phase == corev1.ClaimBound, nil
+}
+
+func (w *Waiter) isServiceReady(ctx context.Context, o *corev1.Service) (bool, error) {
+	svc, err := w.client.CoreV1().Services(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return true, nil
+	}
+	return len(svc.Status.LoadBalancer.Ingress) > 0, nil
+}
+
+func (w *Waiter) isDeploymentReady(ctx context.Context, o *appsv1.Deployment) (bool, error) {
+	deploy, err := w.client.AppsV1().Deployments(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	var cond *appsv1.DeploymentCondition
+	// list all conditions and select that condition which type is Progressing.
+	for i := range deploy.Status.Conditions {
+		c := deploy.Status.Conditions[i]
+		if c.Type == appsv1.DeploymentProgressing {
+			cond = &c
+		}
+	}
+
+	// if deploy.Generation > deploy.Status.ObservedGeneration then the
+	// deployment spec update has not been observed by the controller yet.
+	if deploy.Generation > deploy.Status.ObservedGeneration {
+		return false, nil
+	}
+	// If Progressing condition's reason is ProgressDeadlineExceeded then it is not rolled out.
+	if cond != nil && cond.Reason == "ProgressDeadlineExceeded" {
+		return false, errors.New("deployment exceeded its progress deadline")
+	}
+	// if deploy.Status.UpdatedReplicas < *deploy.Spec.Replicas then some of the replicas are updated
+	// and some of them are not.
+	if deploy.Spec.Replicas != nil && deploy.Status.UpdatedReplicas < *deploy.Spec.Replicas {
+		return false, nil
+	}
+	// if deploy.Status.Replicas > deploy.Status.UpdatedReplicas then some of the older replicas
+	// are still being terminated.
+	if deploy.Status.Replicas > deploy.Status.UpdatedReplicas {
+		return false, nil
+	}
+	// if deploy.Status.AvailableReplicas < deploy.Status.UpdatedReplicas then all the replicas are
+	// updated but not all of them are available yet.
+	if deploy.Status.AvailableReplicas < deploy.Status.UpdatedReplicas {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (w *Waiter) isStatefulSetReady(ctx context.Context, o *appsv1.StatefulSet) (bool, error) {
+	sts, err := w.client.AppsV1().StatefulSets(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if sts.Status.ObservedGeneration < sts.Generation {
+		return false, nil
+	}
+	if sts.Spec.Replicas != nil && sts.Status.ReadyReplicas < *sts.Spec.Replicas {
+		return false, nil
+	}
+	if sts.Spec.Replicas != nil && sts.Status.UpdatedReplicas < *sts.Spec.Replicas {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (w *Waiter) isDaemonSetReady(ctx context.Context, o *appsv1.DaemonSet) (bool, error) {
+	ds, err := w.client.AppsV1().DaemonSets(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if ds.Status.ObservedGeneration < ds.Generation {
+		return false, nil
+	}
+	return ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+		ds.Status.NumberAvailable >= ds.Status.UpdatedNumberScheduled, nil
+}
+
+func (w *Waiter) isJobReady(ctx context.Context, o *batchv1.Job) (bool, error) {
+	job, err := w.client.BatchV1().Jobs(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return false, errors.Errorf("job %s/%s failed: %s", job.Namespace, job.Name, c.Message)
+		}
+		if c.Type == batchv1.JobComplete && c.Status == corev1.ConditionTrue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func describeObject(obj runtime.Object) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return fmt.Sprintf("%T", obj)
+	}
+	return fmt.Sprintf("%T %s/%s", obj, accessor.GetNamespace(), accessor.GetName())
+}